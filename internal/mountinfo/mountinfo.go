@@ -0,0 +1,185 @@
+// Package mountinfo parses /proc/self/mountinfo into a structured table, so
+// callers can answer "what's mounted under this path" without shelling out
+// to findmnt and without hardcoding which subdirectories fchroot itself
+// mounts.
+package mountinfo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MountEntry is one row of /proc/self/mountinfo.
+type MountEntry struct {
+	ID             int
+	ParentID       int
+	Major          int
+	Minor          int
+	Root           string
+	MountPoint     string
+	Options        string
+	OptionalFields []string
+	FSType         string
+	Source         string
+	SuperOptions   string
+}
+
+// MountTable is every mount visible in the current mount namespace, indexed
+// by mount ID (Parent looks up an entry's parent ID through that index).
+type MountTable struct {
+	entries []MountEntry
+	byID    map[int]*MountEntry
+}
+
+// Parse reads and parses /proc/self/mountinfo.
+func Parse() (*MountTable, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("reading /proc/self/mountinfo: %w", err)
+	}
+
+	t := &MountTable{byID: make(map[int]*MountEntry)}
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		entry, err := parseLine(line)
+		if err != nil {
+			// A line we can't parse shouldn't take down the whole table;
+			// skip it and keep going.
+			continue
+		}
+		t.entries = append(t.entries, entry)
+	}
+	for i := range t.entries {
+		t.byID[t.entries[i].ID] = &t.entries[i]
+	}
+	return t, nil
+}
+
+// Mounts is a convenience wrapper returning every entry from a fresh parse.
+func Mounts() ([]MountEntry, error) {
+	t, err := Parse()
+	if err != nil {
+		return nil, err
+	}
+	return t.entries, nil
+}
+
+// Entries returns every mount in the table.
+func (t *MountTable) Entries() []MountEntry {
+	return t.entries
+}
+
+// Parent returns the parent mount of e, if it's present in the table.
+func (t *MountTable) Parent(e MountEntry) (MountEntry, bool) {
+	p, ok := t.byID[e.ParentID]
+	if !ok {
+		return MountEntry{}, false
+	}
+	return *p, true
+}
+
+// Under returns every mount whose mount point is path itself or a
+// descendant of it, in the order mountinfo listed them (outermost first).
+func (t *MountTable) Under(path string) []MountEntry {
+	path = filepath.Clean(path)
+	var matches []MountEntry
+	for _, e := range t.entries {
+		mp := filepath.Clean(e.MountPoint)
+		if mp == path || strings.HasPrefix(mp, path+string(filepath.Separator)) {
+			matches = append(matches, e)
+		}
+	}
+	return matches
+}
+
+// IsMounted reports whether path is itself a mount point.
+func (t *MountTable) IsMounted(path string) bool {
+	path = filepath.Clean(path)
+	for _, e := range t.entries {
+		if filepath.Clean(e.MountPoint) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLine parses one /proc/self/mountinfo row, e.g.:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// Fields up to the mount options are fixed; after that a variable number of
+// optional fields precede a "-" separator, followed by fstype/source/options.
+func parseLine(line string) (MountEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 10 {
+		return MountEntry{}, fmt.Errorf("malformed mountinfo line: %q", line)
+	}
+
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return MountEntry{}, fmt.Errorf("bad mount ID in %q: %w", line, err)
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return MountEntry{}, fmt.Errorf("bad parent ID in %q: %w", line, err)
+	}
+
+	majMin := strings.SplitN(fields[2], ":", 2)
+	if len(majMin) != 2 {
+		return MountEntry{}, fmt.Errorf("bad major:minor in %q", line)
+	}
+	major, _ := strconv.Atoi(majMin[0])
+	minor, _ := strconv.Atoi(majMin[1])
+
+	sepIdx := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sepIdx = i
+			break
+		}
+	}
+	if sepIdx == -1 || sepIdx+3 >= len(fields) {
+		return MountEntry{}, fmt.Errorf("missing '-' separator in %q", line)
+	}
+
+	return MountEntry{
+		ID:             id,
+		ParentID:       parentID,
+		Major:          major,
+		Minor:          minor,
+		Root:           unescapeOctal(fields[3]),
+		MountPoint:     unescapeOctal(fields[4]),
+		Options:        fields[5],
+		OptionalFields: append([]string{}, fields[6:sepIdx]...),
+		FSType:         fields[sepIdx+1],
+		Source:         unescapeOctal(fields[sepIdx+2]),
+		SuperOptions:   fields[sepIdx+3],
+	}, nil
+}
+
+// unescapeOctal decodes the kernel's mountinfo escaping of whitespace and
+// backslashes (e.g. "\040" for a space), used whenever a path field could
+// otherwise be confused with the field separator. Sequences that aren't
+// valid octal escapes are left untouched.
+func unescapeOctal(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
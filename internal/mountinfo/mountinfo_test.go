@@ -0,0 +1,110 @@
+package mountinfo
+
+import "testing"
+
+func TestUnescapeOctal(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"no escapes", "/mnt/chroot", "/mnt/chroot"},
+		{"escaped space", `/mnt/my\040dir`, "/mnt/my dir"},
+		{"escaped tab", `/mnt/a\011b`, "/mnt/a\tb"},
+		{"escaped newline", `/mnt/a\012b`, "/mnt/a\nb"},
+		{"escaped backslash", `/mnt/a\134b`, `/mnt/a\b`},
+		{"multiple escapes", `/mnt/my\040weird\040dir`, "/mnt/my weird dir"},
+		{"incomplete escape left alone", `/mnt/a\04`, `/mnt/a\04`},
+		{"trailing backslash left alone", `/mnt/a\`, `/mnt/a\`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := unescapeOctal(tc.in); got != tc.want {
+				t.Errorf("unescapeOctal(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestUnder pins down that Under() matches a directory exactly as well as
+// its descendants. main.go's umountEssentials filters that exact match back
+// out, so an overlay's own mergedDir (owned by ov.teardown, not the generic
+// sweep) is unmounted only once; if Under() ever stopped returning the path
+// itself, that filter would silently become dead code.
+func TestUnder(t *testing.T) {
+	table := &MountTable{entries: []MountEntry{
+		{ID: 1, MountPoint: "/mnt/chroot"},
+		{ID: 2, MountPoint: "/mnt/chroot/proc"},
+		{ID: 3, MountPoint: "/mnt/chroot/sys"},
+		{ID: 4, MountPoint: "/mnt/other"},
+	}}
+
+	got := table.Under("/mnt/chroot")
+	if len(got) != 3 {
+		t.Fatalf("Under(/mnt/chroot) = %d entries, want 3: %+v", len(got), got)
+	}
+
+	var sawSelf bool
+	for _, e := range got {
+		if e.MountPoint == "/mnt/chroot" {
+			sawSelf = true
+		}
+	}
+	if !sawSelf {
+		t.Error("Under(path) didn't include path itself; callers that filter it out explicitly (e.g. umountEssentials) would stop doing anything if this ever changed")
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	t.Run("well-formed line", func(t *testing.T) {
+		line := "36 35 98:0 / /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue"
+		e, err := parseLine(line)
+		if err != nil {
+			t.Fatalf("parseLine returned error: %v", err)
+		}
+		switch {
+		case e.ID != 36, e.ParentID != 35, e.Major != 98, e.Minor != 0,
+			e.Root != "/", e.MountPoint != "/mnt2", e.Options != "rw,noatime",
+			e.FSType != "ext3", e.Source != "/dev/root", e.SuperOptions != "rw,errors=continue":
+			t.Errorf("parseLine(%q) = %+v, unexpected field value", line, e)
+		}
+		if len(e.OptionalFields) != 1 || e.OptionalFields[0] != "master:1" {
+			t.Errorf("OptionalFields = %v, want [master:1]", e.OptionalFields)
+		}
+	})
+
+	t.Run("octal-escaped mount point", func(t *testing.T) {
+		line := `37 35 98:1 / /mnt/my\040chroot rw - ext3 /dev/root rw`
+		e, err := parseLine(line)
+		if err != nil {
+			t.Fatalf("parseLine returned error: %v", err)
+		}
+		if e.MountPoint != "/mnt/my chroot" {
+			t.Errorf("MountPoint = %q, want %q", e.MountPoint, "/mnt/my chroot")
+		}
+	})
+
+	t.Run("no optional fields", func(t *testing.T) {
+		line := "36 35 98:0 / /mnt2 rw - ext3 /dev/root rw"
+		e, err := parseLine(line)
+		if err != nil {
+			t.Fatalf("parseLine returned error: %v", err)
+		}
+		if len(e.OptionalFields) != 0 {
+			t.Errorf("OptionalFields = %v, want empty", e.OptionalFields)
+		}
+	})
+
+	t.Run("malformed line", func(t *testing.T) {
+		if _, err := parseLine("too short"); err == nil {
+			t.Error("expected error for malformed line, got nil")
+		}
+	})
+
+	t.Run("missing separator", func(t *testing.T) {
+		line := "36 35 98:0 / /mnt2 rw master:1 ext3 /dev/root rw"
+		if _, err := parseLine(line); err == nil {
+			t.Error("expected error for missing '-' separator, got nil")
+		}
+	})
+}
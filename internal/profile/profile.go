@@ -0,0 +1,68 @@
+// Package profile describes a declarative chroot setup: extra mounts, files
+// to seed, environment variables, the hostname to use, and hook scripts to
+// run before entering the chroot and after tearing it down.
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MountSpec describes one filesystem to mount into the chroot, in addition
+// to fchroot's built-in proc/sys/dev set; the built-in set cannot be replaced.
+type MountSpec struct {
+	Source    string `json:"source" yaml:"source"`
+	Target    string `json:"target" yaml:"target"`
+	FSType    string `json:"fstype" yaml:"fstype"`
+	Options   string `json:"options" yaml:"options"`
+	Recursive bool   `json:"recursive" yaml:"recursive"`
+	ReadOnly  bool   `json:"readOnly" yaml:"readOnly"`
+}
+
+// FileSpec describes a file or symlink to place inside the chroot before
+// the target command runs.
+type FileSpec struct {
+	Src     string      `json:"src" yaml:"src"`
+	Dst     string      `json:"dst" yaml:"dst"`
+	Mode    os.FileMode `json:"mode" yaml:"mode"`
+	Symlink bool        `json:"symlink" yaml:"symlink"`
+}
+
+// Profile is the top-level document loaded via the -c flag.
+type Profile struct {
+	Mounts     []MountSpec       `json:"mounts" yaml:"mounts"`
+	Files      []FileSpec        `json:"files" yaml:"files"`
+	Env        map[string]string `json:"env" yaml:"env"`
+	Hostname   string            `json:"hostname" yaml:"hostname"`
+	PreChroot  []string          `json:"preChroot" yaml:"preChroot"`
+	PostUmount []string          `json:"postUmount" yaml:"postUmount"`
+}
+
+// Load reads a profile from path, dispatching on its extension (.json,
+// .yaml or .yml).
+func Load(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading profile %s: %w", path, err)
+	}
+
+	p := &Profile{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("parsing profile %s: %w", path, err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("parsing profile %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported profile format %q (use .json, .yaml or .yml)", ext)
+	}
+	return p, nil
+}
@@ -0,0 +1,217 @@
+// Package securejoin resolves a path inside a chroot without ever following
+// a symlink out of it, closing the CVE-2021-30465-style race where a
+// malicious rootfs contains e.g. "/proc -> ../.." and a naive filepath.Join
+// would mount or write over a host path instead of one inside the chroot.
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks bounds how many symlinks the manual fallback will follow
+// before giving up, mirroring the kernel's own loop protection.
+const maxSymlinks = 40
+
+// Resolved is the result of a symlink-safe resolution. When the resolved
+// target already exists, it also pins an O_PATH descriptor to that exact
+// inode, so a caller can act on it via ProcPath() without re-walking (and
+// re-racing) the path string.
+type Resolved struct {
+	path string
+	fd   int // O_PATH descriptor pinned to path, or -1 if it doesn't exist yet
+}
+
+// Path returns the resolved path as a plain string, for logging and error
+// messages. Passing this to a later syscall reopens the TOCTOU window Join
+// just closed - use ProcPath for that instead.
+func (r *Resolved) Path() string {
+	return r.path
+}
+
+// ProcPath returns a reference to the exact inode Join resolved
+// ("/proc/self/fd/N"), safe to pass to a subsequent mount/open/stat call
+// even if something swaps a path component in between. If the target didn't
+// exist at resolution time there is nothing to pin, and this falls back to
+// the plain path - call Join again once the caller has created the target
+// to get a pinned reference to it.
+func (r *Resolved) ProcPath() string {
+	if r.fd < 0 {
+		return r.path
+	}
+	return fmt.Sprintf("/proc/self/fd/%d", r.fd)
+}
+
+// Close releases the held file descriptor, if any. Safe to call on a
+// Resolved whose target didn't exist at resolution time.
+func (r *Resolved) Close() error {
+	if r.fd < 0 {
+		return nil
+	}
+	fd := r.fd
+	r.fd = -1
+	return unix.Close(fd)
+}
+
+// Exists reports whether Join found something already at this path.
+func (r *Resolved) Exists() bool {
+	return r.fd >= 0
+}
+
+// Child returns a path reference to name inside the directory r resolved -
+// "/proc/self/fd/N/name" when r is pinned, otherwise a plain joined path.
+// When r is pinned, it's safe to pass this to mkdir/open/mount/symlink/unlink even though
+// name itself isn't pre-resolved: the kernel resolves it in a single step
+// relative to the pinned directory, so a swap of any ancestor component
+// can't redirect it - only the narrower, unavoidable race on the leaf name
+// itself remains, the same as any *at(2) syscall relative to a held fd.
+func (r *Resolved) Child(name string) string {
+	return r.ProcPath() + "/" + name
+}
+
+// Join resolves unsafePath against root the way the kernel's own
+// RESOLVE_IN_ROOT does: every symlink is followed but clamped so the
+// resulting path can never walk outside root.
+func Join(root, unsafePath string) (*Resolved, error) {
+	r, err := joinOpenat2(root, unsafePath)
+	if err == nil {
+		return r, nil
+	}
+	if !errors.Is(err, unix.ENOSYS) && !errors.Is(err, unix.EOPNOTSUPP) {
+		// openat2 is available but the resolution itself failed (e.g. it
+		// ran into a /proc magic-link, which RESOLVE_NO_MAGICLINKS refuses) -
+		// don't silently fall back to the weaker manual walk, report it. A
+		// missing target (ENOENT) is the one exception: the manual walk
+		// below still works out where it would be.
+		if !errors.Is(err, unix.ENOENT) {
+			return nil, err
+		}
+	}
+	return joinManual(root, unsafePath)
+}
+
+// JoinParent resolves the parent directory of unsafePath (symlink-safely,
+// exactly like Join) and returns it alongside the final path component, for
+// callers that need to create or mount something at the leaf. The pinned
+// parent directory can't be swapped out from under the later syscall, even
+// though the leaf name itself (which may not exist yet) is still resolved
+// live when that call happens.
+func JoinParent(root, unsafePath string) (*Resolved, string, error) {
+	dir, base := filepath.Split(filepath.Clean("/" + unsafePath))
+	if base == "" {
+		return nil, "", fmt.Errorf("securejoin: %q has no final path component", unsafePath)
+	}
+	r, err := Join(root, dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, base, nil
+}
+
+// joinOpenat2 asks the kernel to resolve unsafePath with RESOLVE_IN_ROOT |
+// RESOLVE_NO_MAGICLINKS, which refuses to resolve outside root and refuses
+// to follow /proc magic-links. Requires Linux 5.6+. The O_PATH descriptor it
+// opens is kept open and handed back via Resolved instead of being
+// discarded, so the caller can operate on the pinned inode rather than
+// reopening its path string.
+func joinOpenat2(root, unsafePath string) (*Resolved, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(rootFd)
+
+	rel := strings.TrimPrefix(filepath.Clean("/"+unsafePath), "/")
+	how := unix.OpenHow{
+		Flags:   unix.O_PATH,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+
+	fd, err := unix.Openat2(rootFd, rel, &how)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &Resolved{path: path, fd: fd}, nil
+}
+
+// joinManual walks unsafePath one component at a time, resolving symlinks
+// by hand and clamping the result to stay under root. Used when openat2 is
+// unavailable (pre-5.6 kernels) or reports the target missing. Once the path
+// is resolved it is pinned with an O_PATH|O_NOFOLLOW open of the resolved
+// path string. The walk and that open are separate steps, and O_NOFOLLOW
+// guards only the final component, so a directory component swapped for a
+// symlink in between is still followed by the open.
+func joinManual(root, unsafePath string) (*Resolved, error) {
+	root = filepath.Clean(root)
+	current := "/"
+	hops := 0
+
+	parts := strings.Split(filepath.Clean("/"+unsafePath), "/")
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		full := filepath.Join(root, next)
+
+		fi, err := os.Lstat(full)
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return nil, err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinks {
+			return nil, fmt.Errorf("securejoin: too many symlinks resolving %s under %s", unsafePath, root)
+		}
+
+		target, err := os.Readlink(full)
+		if err != nil {
+			return nil, err
+		}
+		// Walk the target's own components as well, so any symlink inside it
+		// is resolved and clamped the same way. An absolute target restarts
+		// at root, a relative one continues from the link's directory, and
+		// ".." at root stays at root.
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	full := filepath.Join(root, current)
+	fd, err := unix.Open(full, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		fd = -1
+	}
+	return &Resolved{path: full, fd: fd}, nil
+}
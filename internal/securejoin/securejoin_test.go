@@ -0,0 +1,128 @@
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJoinExistingFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Join(root, "file")
+	if err != nil {
+		t.Fatalf("Join returned error: %v", err)
+	}
+	defer r.Close()
+
+	if !r.Exists() {
+		t.Error("Exists() = false, want true for a file that's actually there")
+	}
+	if r.Path() != filepath.Join(root, "file") {
+		t.Errorf("Path() = %q, want %q", r.Path(), filepath.Join(root, "file"))
+	}
+	data, err := os.ReadFile(r.ProcPath())
+	if err != nil {
+		t.Fatalf("reading via ProcPath(): %v", err)
+	}
+	if string(data) != "hi" {
+		t.Errorf("read %q via ProcPath(), want %q", data, "hi")
+	}
+}
+
+func TestJoinMissingTarget(t *testing.T) {
+	root := t.TempDir()
+
+	r, err := Join(root, "does/not/exist")
+	if err != nil {
+		t.Fatalf("Join returned error: %v", err)
+	}
+	defer r.Close()
+
+	if r.Exists() {
+		t.Error("Exists() = true, want false for a target that was never created")
+	}
+	want := filepath.Join(root, "does/not/exist")
+	if r.Path() != want {
+		t.Errorf("Path() = %q, want %q", r.Path(), want)
+	}
+}
+
+func TestJoinClampsAbsoluteSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("top secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A rigged rootfs: "escape" looks like a normal entry but is actually a
+	// symlink pointing at an absolute path outside root.
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Join(root, "escape/secret")
+	if err != nil {
+		t.Fatalf("Join returned error: %v", err)
+	}
+	defer r.Close()
+
+	if !strings.HasPrefix(r.Path(), root) {
+		t.Fatalf("Join escaped root: resolved to %q, root is %q", r.Path(), root)
+	}
+	if r.Path() == filepath.Join(outside, "secret") {
+		t.Fatalf("Join followed the symlink outside root to %q", r.Path())
+	}
+}
+
+func TestJoinClampsRelativeSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	// A symlink whose target tries to walk above root via "..".
+	if err := os.Symlink("../../../../etc/passwd", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Join(root, "escape")
+	if err != nil {
+		t.Fatalf("Join returned error: %v", err)
+	}
+	defer r.Close()
+
+	if !strings.HasPrefix(r.Path(), root) {
+		t.Fatalf("Join escaped root: resolved to %q, root is %q", r.Path(), root)
+	}
+}
+
+func TestJoinParentAndChild(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, name, err := JoinParent(root, "etc/resolv.conf")
+	if err != nil {
+		t.Fatalf("JoinParent returned error: %v", err)
+	}
+	defer parent.Close()
+
+	if name != "resolv.conf" {
+		t.Errorf("name = %q, want %q", name, "resolv.conf")
+	}
+	if !parent.Exists() {
+		t.Error("parent.Exists() = false, want true for etc which was created above")
+	}
+
+	if err := os.WriteFile(parent.Child(name), []byte("nameserver 1.1.1.1\n"), 0644); err != nil {
+		t.Fatalf("writing via Child(): %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "etc/resolv.conf"))
+	if err != nil {
+		t.Fatalf("reading back written file: %v", err)
+	}
+	if string(got) != "nameserver 1.1.1.1\n" {
+		t.Errorf("content = %q, want %q", got, "nameserver 1.1.1.1\n")
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"debug/elf"
 	"flag"
 	"fmt"
 	"io"
@@ -8,17 +11,41 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"fchroot/internal/mountinfo"
+	"fchroot/internal/profile"
+	"fchroot/internal/securejoin"
+
+	"golang.org/x/sys/unix"
 )
 
+const nsReexecEnvVar = "FCHROOT_NS_CHILD"
+
 var (
 	userSpec       = flag.String("u", "", "user[:group] to run as")
 	skipResolvConf = flag.Bool("r", false, "do not update resolv.conf")
 	showHelp       = flag.Bool("h", false, "show help")
 	verbose        = flag.Bool("v", false, "verbose output")
+	nsIsolate      = flag.Bool("N", false, "run the chroot inside a private mount namespace")
+	profilePath    = flag.String("c", "", "path to a mount profile (YAML/JSON)")
+	overlay        bool
+	upperDir       = flag.String("upperdir", "", "upper/work layer directory for -o (default: ephemeral tmpfs)")
+	exportDiffPath = flag.String("export-diff", "", "export the overlay's upper layer as a tar.gz on exit")
+	archFlag       = flag.String("arch", "", "target architecture (auto-detected from <chroot>/bin/sh if empty)")
+	cleanupFlag    = flag.Bool("cleanup", false, "unmount everything fchroot left behind under chroot-dir and exit")
 )
 
+func init() {
+	flag.BoolVar(&overlay, "o", false, "mount chroot-dir as a read-only overlay lower layer")
+	flag.BoolVar(&overlay, "overlay", false, "mount chroot-dir as a read-only overlay lower layer")
+}
+
 func main() {
 	flag.Parse()
 
@@ -54,32 +81,121 @@ func main() {
 	}
 	chrootDir = absChrootDir
 
+	// --cleanup: just tear down whatever is mounted under chrootDir (e.g.
+	// left behind by a killed fchroot) and exit, without starting a session.
+	if *cleanupFlag {
+		umountEssentials(chrootDir)
+		os.Exit(0)
+	}
+
+	// -N: re-exec ourselves detached into a fresh mount namespace so that
+	// every mount we set up below (and any the chrooted process adds) stays
+	// invisible to the host and is torn down automatically on exit.
+	if *nsIsolate && os.Getenv(nsReexecEnvVar) == "" {
+		reexecInPrivateMountNS()
+	}
+	if os.Getenv(nsReexecEnvVar) != "" {
+		if err := makeMountsPrivate(); err != nil {
+			fatalf("Failed to isolate mount namespace: %v", err)
+		}
+	}
+
+	// -o/--overlay: treat chrootDir as a read-only lower layer and run
+	// against a disposable merged mount instead, so nothing written during
+	// the session touches the base rootfs.
+	var ov *overlayState
+	var cross atomic.Pointer[crossArchState]
+	if overlay {
+		ov, err = setupOverlay(chrootDir, *upperDir)
+		if err != nil {
+			fatalf("Failed to set up overlay: %v", err)
+		}
+		chrootDir = ov.mergedDir
+	}
+
 	logInfo("Using chroot directory: %s", chrootDir)
 
+	// Загружаем профиль, если он задан
+	var prof *profile.Profile
+	if *profilePath != "" {
+		prof, err = profile.Load(*profilePath)
+		if err != nil {
+			fatalf("Failed to load profile: %v", err)
+		}
+		logInfo("Loaded profile from %s", *profilePath)
+	}
+
+	mounts := essentialMounts()
+	if prof != nil {
+		mounts = append(mounts, prof.Mounts...)
+	}
+
 	// Обработка прерывания для корректного размонтирования
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigChan
 		logInfo("Received interrupt signal, unmounting...")
+		if c := cross.Load(); c != nil {
+			c.teardown()
+		}
 		umountEssentials(chrootDir)
+		runPostUmountHooks(chrootDir, prof)
+		if ov != nil {
+			ov.teardown(*exportDiffPath)
+		}
 		os.Exit(1)
 	}()
 
 	// Проверка mountpoint перед началом
 	checkMountpoint(chrootDir)
 
-	// Монтирование (proc, sys, dev)
-	mountEssentials(chrootDir)
-	defer umountEssentials(chrootDir)
+	// Монтирование (proc, sys, dev, ... плюс всё из профиля)
+	mountEssentials(chrootDir, mounts)
+	defer func() {
+		umountEssentials(chrootDir)
+		runPostUmountHooks(chrootDir, prof)
+		if ov != nil {
+			ov.teardown(*exportDiffPath)
+		}
+	}()
 
 	// resolv.conf
 	if !*skipResolvConf {
 		setupResolvConf(chrootDir)
 	}
 
+	if prof != nil {
+		applyFiles(chrootDir, prof.Files)
+		applyHostname(chrootDir, prof.Hostname)
+		runPreChrootHooks(chrootDir, prof)
+	}
+
+	// --arch / auto-detection: if the rootfs targets a different CPU
+	// architecture than the host, wire up a static QEMU interpreter via
+	// binfmt_misc so the chrooted command can run transparently.
+	targetArch := *archFlag
+	if targetArch == "" {
+		if detected, derr := detectArch(chrootDir); derr == nil {
+			if detected != hostArchName() {
+				targetArch = detected
+				logInfo("Auto-detected chroot architecture %s (host is %s)", detected, hostArchName())
+			}
+		} else {
+			logInfo("Could not auto-detect chroot architecture: %v", derr)
+		}
+	}
+	if targetArch != "" && targetArch != hostArchName() {
+		c, err := setupCrossArch(chrootDir, targetArch)
+		if err != nil {
+			fatalf("Failed to set up cross-arch support for %s: %v", targetArch, err)
+		}
+		cross.Store(c)
+		defer c.teardown()
+	}
+
 	// Запуск chroot
-	runChroot(chrootDir, *userSpec, cmdArgs)
+	runChroot(chrootDir, *userSpec, cmdArgs, envFromProfile(prof))
 }
 
 func fatalf(format string, args ...interface{}) {
@@ -103,79 +219,633 @@ func printHelp() {
 	-u <user>[:group]   Run as specified user
 	-r                  Do not update resolv.conf
 	-v                  Verbose output
+	-N                  Run inside a private mount namespace
+	-c <file>           Apply a mount profile (YAML/JSON)
+	-o, --overlay       Run against a disposable overlayfs layer
+	--upperdir <dir>    Overlay upper/work layer (default: ephemeral tmpfs)
+	--export-diff <f>   Export the overlay's upper layer as a tar.gz on exit
+	--arch <arch>       Target architecture (auto-detected if omitted)
+	--cleanup           Unmount everything under chroot-dir and exit
 
 	Examples:
 	fchroot /mnt/chroot
 	fchroot -u nobody /mnt/chroot /bin/sh
 	fchroot -v /mnt/chroot /bin/bash -l
+	fchroot -N /mnt/chroot
+	fchroot -c profile.yaml /mnt/chroot
+	fchroot -o --export-diff session.tar.gz /mnt/chroot
+	fchroot --arch aarch64 /mnt/arm64-chroot
+	fchroot --cleanup /mnt/chroot
 
 	Default command: /bin/bash
 	`)
 }
 
-func mountEssentials(chrootDir string) {
-	mounts := []struct {
-		name   string
-		source string
-		fstype string
-	}{
-		{"proc", "/proc", "proc"},
-		{"sys", "/sys", "sysfs"},
-		{"dev", "/dev", ""}, // bind mount
+// reexecInPrivateMountNS re-launches the current process as a child that owns
+// its own mount namespace (CLONE_NEWNS), waits for it, and exits with its
+// status. The child detects it is already isolated via nsReexecEnvVar and
+// skips this step.
+func reexecInPrivateMountNS() {
+	self, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to resolve own executable for -N re-exec: %v", err)
+	}
+
+	logInfo("Re-executing in a private mount namespace...")
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), nsReexecEnvVar+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
+
+	err = cmd.Run()
+	exitCode := 0
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else {
+			fatalf("Failed to re-exec in private mount namespace: %v", err)
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// makeMountsPrivate marks the whole mount tree MS_SLAVE|MS_REC so that
+// nothing we mount from here on propagates back out to the host's namespace.
+func makeMountsPrivate() error {
+	return syscall.Mount("", "/", "", syscall.MS_SLAVE|syscall.MS_REC, "")
+}
+
+// overlayState tracks the layers of an ephemeral overlayfs chroot set up by
+// -o/--overlay, so teardown can unwind exactly what was created.
+type overlayState struct {
+	lowerDir  string
+	upperDir  string
+	workDir   string
+	mergedDir string
+	tmpBase   string // ephemeral tmpfs backing upper/work, empty when --upperdir was user-supplied
+}
+
+// setupOverlay mounts chrootDir read-only as the overlay's lower layer and a
+// merged view on top of it, backed by upperDirFlag if given or an ephemeral
+// tmpfs otherwise.
+func setupOverlay(chrootDir, upperDirFlag string) (*overlayState, error) {
+	merged, err := os.MkdirTemp("", "fchroot-overlay-merged-")
+	if err != nil {
+		return nil, fmt.Errorf("creating overlay mountpoint: %w", err)
+	}
+
+	ov := &overlayState{lowerDir: chrootDir, mergedDir: merged}
+
+	if upperDirFlag != "" {
+		ov.upperDir = upperDirFlag
+		ov.workDir = filepath.Join(filepath.Dir(strings.TrimRight(upperDirFlag, "/")), ".fchroot-overlay-work")
+		if err := os.MkdirAll(ov.upperDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating upperdir %s: %w", ov.upperDir, err)
+		}
+		if err := os.MkdirAll(ov.workDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating workdir %s: %w", ov.workDir, err)
+		}
+	} else {
+		base, err := os.MkdirTemp("", "fchroot-overlay-")
+		if err != nil {
+			return nil, fmt.Errorf("creating ephemeral overlay dir: %w", err)
+		}
+		if err := syscall.Mount("tmpfs", base, "tmpfs", 0, ""); err != nil {
+			os.RemoveAll(base)
+			return nil, fmt.Errorf("mounting tmpfs for ephemeral overlay: %w", err)
+		}
+		ov.tmpBase = base
+		ov.upperDir = filepath.Join(base, "upper")
+		ov.workDir = filepath.Join(base, "work")
+		if err := os.MkdirAll(ov.upperDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating upper layer: %w", err)
+		}
+		if err := os.MkdirAll(ov.workDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating work layer: %w", err)
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", ov.lowerDir, ov.upperDir, ov.workDir)
+	logInfo("Mounting overlay: %s", data)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return nil, fmt.Errorf("mounting overlay at %s: %w", merged, err)
+	}
+
+	fmt.Printf("✓ Overlay ready: %s (lower=%s)\n", merged, ov.lowerDir)
+	return ov, nil
+}
+
+// teardown unmounts the overlay, optionally exporting the upper layer as a
+// tar.gz first, and cleans up any directories fchroot created for it.
+func (ov *overlayState) teardown(exportDiffPath string) {
+	if exportDiffPath != "" {
+		if err := exportUpperDiff(ov.upperDir, exportDiffPath); err != nil {
+			fmt.Fprintf(os.Stderr, "✗ Failed to export overlay diff: %v\n", err)
+		} else {
+			fmt.Printf("✓ Exported overlay diff to %s\n", exportDiffPath)
+		}
+	}
+
+	// Always attempt the removal, even if the unmount failed: umountEssentials
+	// no longer touches ov.mergedDir itself, but a caller that tears down an
+	// overlay it didn't start through the normal signal/exit path (or a future
+	// caller) could still race this unmount, and an already-unmounted
+	// mergedDir shouldn't be left behind under /tmp just because Unmount
+	// returned an error for it.
+	if err := syscall.Unmount(ov.mergedDir, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "✗ Failed to unmount overlay %s: %v\n", ov.mergedDir, err)
+	}
+	os.Remove(ov.mergedDir)
+
+	if ov.tmpBase != "" {
+		if err := syscall.Unmount(ov.tmpBase, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "✗ Failed to unmount overlay tmpfs %s: %v\n", ov.tmpBase, err)
+			return
+		}
+		os.RemoveAll(ov.tmpBase)
+	}
+}
+
+// exportUpperDiff writes the overlay's upper layer to destPath as a tar.gz.
+func exportUpperDiff(upperDir, destPath string) error {
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	return filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		if wh, ok := whiteoutName(rel, info); ok {
+			return writeWhiteoutMarker(tw, wh)
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+
+		if info.IsDir() && isOpaqueDir(path) {
+			if err := writeWhiteoutMarker(tw, filepath.Join(rel, ".wh..wh..opq")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// whiteoutName reports whether info is an overlayfs whiteout (a character
+// device with major:minor 0:0, the kernel's marker for "this entry was
+// deleted in the upper layer") and, if so, the AUFS-style ".wh."-prefixed
+// marker name it should be rewritten to. A raw device node would otherwise
+// require root (mknod) to extract; the marker is a plain zero-byte file any
+// tar consumer can round-trip.
+func whiteoutName(rel string, info os.FileInfo) (string, bool) {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return "", false
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || unix.Major(uint64(sys.Rdev)) != 0 || unix.Minor(uint64(sys.Rdev)) != 0 {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(rel), ".wh."+filepath.Base(rel)), true
+}
+
+// isOpaqueDir reports whether dir is marked opaque by overlayfs (everything
+// beneath it in the lower layers is hidden), via the trusted.overlay.opaque
+// xattr the kernel sets on it.
+func isOpaqueDir(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, "trusted.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// writeWhiteoutMarker appends a zero-byte regular file entry named name,
+// the AUFS/OCI convention for recording a deletion in a layer diff.
+func writeWhiteoutMarker(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	})
+}
+
+// binfmtSignature holds the magic/mask pair binfmt_misc needs to recognize
+// an ELF binary of a given target architecture, taken from qemu-user-static's
+// binfmt registration definitions.
+type binfmtSignature struct {
+	magic string
+	mask  string
+}
+
+var binfmtSignatures = map[string]binfmtSignature{
+	"arm":     {"\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"aarch64": {"\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"riscv64": {"\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"ppc64le": {"\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff"},
+	"mips":    {"\x7fELF\x01\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08", "\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff"},
+}
+
+// hostArchName maps runtime.GOARCH to the qemu-user-static architecture
+// suffix, e.g. "amd64" -> "x86_64".
+func hostArchName() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	case "arm64":
+		return "aarch64"
+	default:
+		return runtime.GOARCH
 	}
+}
 
+// detectArch inspects <chrootDir>/bin/sh's ELF header to determine the
+// rootfs's architecture, expressed as a qemu-user-static suffix.
+func detectArch(chrootDir string) (string, error) {
+	r, err := securejoin.Join(chrootDir, "bin/sh")
+	if err != nil {
+		return "", fmt.Errorf("resolving %s/bin/sh: %w", chrootDir, err)
+	}
+	defer r.Close()
+	f, err := elf.Open(r.ProcPath())
+	if err != nil {
+		return "", fmt.Errorf("reading ELF header of %s: %w", r.Path(), err)
+	}
+	defer f.Close()
+
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "x86_64", nil
+	case elf.EM_386:
+		return "i386", nil
+	case elf.EM_ARM:
+		return "arm", nil
+	case elf.EM_AARCH64:
+		return "aarch64", nil
+	case elf.EM_RISCV:
+		if f.Class == elf.ELFCLASS64 {
+			return "riscv64", nil
+		}
+		return "riscv32", nil
+	case elf.EM_PPC64:
+		return "ppc64le", nil
+	case elf.EM_MIPS:
+		return "mips", nil
+	default:
+		return "", fmt.Errorf("unsupported ELF machine type %v", f.Machine)
+	}
+}
+
+// crossArchState tracks the static QEMU interpreter fchroot bind-mounted
+// into the chroot for --arch, so it can be cleanly removed on exit.
+type crossArchState struct {
+	arch        string
+	destDir     *securejoin.Resolved
+	destName    string
+	createdDest bool
+}
+
+// dest is the real host path to the bind-mounted qemu interpreter, as a
+// plain string for teardown's error message; the unmount and removal
+// themselves go through destDir.Child.
+func (c *crossArchState) dest() string {
+	return filepath.Join(c.destDir.Path(), c.destName)
+}
+
+// setupCrossArch locates a static qemu-<arch>-static on the host, bind-mounts
+// it into <chrootDir>/usr/bin, and makes sure binfmt_misc knows how to run
+// ELF binaries of that architecture through it.
+func setupCrossArch(chrootDir, arch string) (*crossArchState, error) {
+	qemuBin := "qemu-" + arch + "-static"
+	qemuPath, err := exec.LookPath(qemuBin)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found on host (install qemu-user-static): %w", qemuBin, err)
+	}
+
+	usrR, binName, err := securejoin.JoinParent(chrootDir, "usr/bin")
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s/usr/bin: %w", chrootDir, err)
+	}
+	if err := os.MkdirAll(usrR.Child(binName), 0755); err != nil {
+		usrR.Close()
+		return nil, fmt.Errorf("creating %s/usr/bin: %w", chrootDir, err)
+	}
+	usrR.Close()
+
+	destDir, destName, err := securejoin.JoinParent(chrootDir, "usr/bin/"+qemuBin)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s/usr/bin/%s: %w", chrootDir, qemuBin, err)
+	}
+	dest := filepath.Join(destDir.Path(), destName)
+
+	createdDest := false
+	if _, err := os.Stat(destDir.Child(destName)); os.IsNotExist(err) {
+		f, err := os.OpenFile(destDir.Child(destName), os.O_CREATE|os.O_WRONLY, 0755)
+		if err != nil {
+			destDir.Close()
+			return nil, fmt.Errorf("creating mountpoint for %s: %w", dest, err)
+		}
+		f.Close()
+		createdDest = true
+	}
+
+	logInfo("Bind-mounting %s -> %s", qemuPath, dest)
+	if err := syscall.Mount(qemuPath, destDir.Child(destName), "", syscall.MS_BIND, ""); err != nil {
+		destDir.Close()
+		return nil, fmt.Errorf("bind-mounting %s -> %s: %w", qemuPath, dest, err)
+	}
+
+	// binfmt_misc stores interpreterPath and reopens it on every exec of a
+	// matching binary for as long as the chroot session runs, so it needs
+	// the real host path, not a reference pinned to our own fd table.
+	if err := ensureBinfmt(arch, dest); err != nil {
+		syscall.Unmount(destDir.Child(destName), 0)
+		destDir.Close()
+		return nil, err
+	}
+
+	fmt.Printf("✓ Cross-arch ready: %s via %s\n", arch, qemuBin)
+	return &crossArchState{arch: arch, destDir: destDir, destName: destName, createdDest: createdDest}, nil
+}
+
+// ensureBinfmt registers a binfmt_misc handler for arch if one isn't
+// already present.
+func ensureBinfmt(arch, interpreterPath string) error {
+	entry := "/proc/sys/fs/binfmt_misc/qemu-" + arch
+	if _, err := os.Stat(entry); err == nil {
+		logInfo("binfmt_misc entry for %s already registered", arch)
+		return nil
+	}
+
+	sig, ok := binfmtSignatures[arch]
+	if !ok {
+		return fmt.Errorf("no binfmt_misc signature known for arch %s", arch)
+	}
+
+	registration := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:OC\n", arch, sig.magic, sig.mask, interpreterPath)
+	if err := os.WriteFile("/proc/sys/fs/binfmt_misc/register", []byte(registration), 0200); err != nil {
+		return fmt.Errorf("registering binfmt_misc handler for %s: %w", arch, err)
+	}
+	logInfo("Registered binfmt_misc handler for %s", arch)
+	return nil
+}
+
+func (c *crossArchState) teardown() {
+	dest := c.dest()
+	if err := syscall.Unmount(c.destDir.Child(c.destName), 0); err != nil {
+		fmt.Fprintf(os.Stderr, "✗ Failed to unmount qemu interpreter %s: %v\n", dest, err)
+	}
+	if c.createdDest {
+		os.Remove(c.destDir.Child(c.destName))
+	}
+	c.destDir.Close()
+}
+
+// essentialMounts returns fchroot's built-in set (proc, sys, dev, dev/pts,
+// and tmpfs on run and tmp), expressed as
+// profile.MountSpec entries so a user-supplied profile's extra mounts can
+// simply be appended to the same list.
+func essentialMounts() []profile.MountSpec {
+	return []profile.MountSpec{
+		{Source: "proc", Target: "proc", FSType: "proc"},
+		{Source: "sysfs", Target: "sys", FSType: "sysfs"},
+		{Source: "/dev", Target: "dev", FSType: "", Recursive: true},
+		{Source: "devpts", Target: "dev/pts", FSType: "devpts"},
+		{Source: "tmpfs", Target: "run", FSType: "tmpfs"},
+		{Source: "tmpfs", Target: "tmp", FSType: "tmpfs"},
+	}
+}
+
+// mountFlags translates a profile.MountSpec's declarative fields into the
+// syscall.Mount flags/data pair.
+func mountFlags(m profile.MountSpec) (flags uintptr, data string) {
+	if m.FSType == "" {
+		flags |= syscall.MS_BIND
+	}
+	if m.Recursive {
+		flags |= syscall.MS_REC
+	}
+	if m.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return flags, m.Options
+}
+
+func mountEssentials(chrootDir string, mounts []profile.MountSpec) {
 	logInfo("Mounting essential filesystems...")
 
 	for _, mnt := range mounts {
-		target := filepath.Join(chrootDir, mnt.name)
+		parent, name, err := securejoin.JoinParent(chrootDir, mnt.Target)
+		if err != nil {
+			fatalf("Failed to resolve mount target %s: %v", mnt.Target, err)
+		}
+		target := filepath.Join(parent.Path(), name)
 
 		// Создаём директорию, если её нет
-		if err := os.MkdirAll(target, 0755); err != nil {
+		if err := os.MkdirAll(parent.Child(name), 0755); err != nil {
+			parent.Close()
 			fatalf("Failed to create directory %s: %v", target, err)
 		}
 
 		// Проверяем, не смонтировано ли уже
 		if isMounted(target) {
 			logInfo("%s is already mounted, skipping", target)
+			parent.Close()
 			continue
 		}
 
-		args := []string{}
-		if mnt.fstype == "" {
-			// bind mount
-			args = []string{"--bind", mnt.source, target}
-			logInfo("Mounting %s (bind) -> %s", mnt.source, target)
+		flags, data := mountFlags(mnt)
+		if flags&syscall.MS_BIND != 0 {
+			logInfo("Mounting %s (bind) -> %s", mnt.Source, target)
 		} else {
-			// regular mount
-			args = []string{"-t", mnt.fstype, mnt.source, target}
-			logInfo("Mounting %s (%s) -> %s", mnt.source, mnt.fstype, target)
+			logInfo("Mounting %s (%s) -> %s", mnt.Source, mnt.FSType, target)
+		}
+
+		if err := syscall.Mount(mnt.Source, parent.Child(name), mnt.FSType, flags, data); err != nil {
+			parent.Close()
+			fatalf("Failed to mount %s -> %s: %v", mnt.Source, target, err)
+		}
+		fmt.Printf("✓ Mounted %s\n", mnt.Target)
+		parent.Close()
+	}
+}
+
+// applyFiles copies or symlinks each FileSpec from a profile into the
+// chroot, creating parent directories as needed.
+func applyFiles(chrootDir string, files []profile.FileSpec) {
+	for _, f := range files {
+		parent, name, err := securejoin.JoinParent(chrootDir, f.Dst)
+		if err != nil {
+			fatalf("Failed to resolve file target %s: %v", f.Dst, err)
+		}
+		dst := filepath.Join(parent.Path(), name)
+
+		if err := os.MkdirAll(parent.Path(), 0755); err != nil {
+			parent.Close()
+			fatalf("Failed to create directory for %s: %v", dst, err)
+		}
+
+		if f.Symlink {
+			_ = os.Remove(parent.Child(name))
+			if err := os.Symlink(f.Src, parent.Child(name)); err != nil {
+				parent.Close()
+				fatalf("Failed to symlink %s -> %s: %v", f.Src, dst, err)
+			}
+			fmt.Printf("✓ Symlinked %s → %s\n", f.Src, dst)
+			parent.Close()
+			continue
 		}
 
-		cmd := exec.Command("mount", args...)
+		src, err := os.Open(f.Src)
+		if err != nil {
+			parent.Close()
+			fatalf("Failed to open %s: %v", f.Src, err)
+		}
+		out, err := os.OpenFile(parent.Child(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode(f.Mode))
+		if err != nil {
+			src.Close()
+			parent.Close()
+			fatalf("Failed to create %s: %v", dst, err)
+		}
+		_, err = io.Copy(out, src)
+		src.Close()
+		out.Close()
+		parent.Close()
+		if err != nil {
+			fatalf("Failed to copy %s -> %s: %v", f.Src, dst, err)
+		}
+		fmt.Printf("✓ Copied %s → %s\n", f.Src, dst)
+	}
+}
+
+func fileMode(mode os.FileMode) os.FileMode {
+	if mode == 0 {
+		return 0644
+	}
+	return mode
+}
+
+// applyHostname writes /etc/hostname inside the chroot. A profile with no
+// hostname set is a no-op.
+func applyHostname(chrootDir, hostname string) {
+	if hostname == "" {
+		return
+	}
+	parent, name, err := securejoin.JoinParent(chrootDir, "etc/hostname")
+	if err != nil {
+		fatalf("Failed to resolve etc/hostname: %v", err)
+	}
+	defer parent.Close()
+	if err := os.WriteFile(parent.Child(name), []byte(hostname+"\n"), 0644); err != nil {
+		fatalf("Failed to write hostname: %v", err)
+	}
+	logInfo("Set chroot hostname to %s", hostname)
+}
+
+func runPreChrootHooks(chrootDir string, prof *profile.Profile) {
+	if prof == nil {
+		return
+	}
+	runHooks(chrootDir, "pre-chroot", prof.PreChroot)
+}
+
+func runPostUmountHooks(chrootDir string, prof *profile.Profile) {
+	if prof == nil {
+		return
+	}
+	runHooks(chrootDir, "post-umount", prof.PostUmount)
+}
+
+func runHooks(chrootDir, stage string, scripts []string) {
+	for _, script := range scripts {
+		logInfo("Running %s hook: %s", stage, script)
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Dir = chrootDir
+		cmd.Env = append(os.Environ(), "CHROOT_DIR="+chrootDir)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-
 		if err := cmd.Run(); err != nil {
-			fatalf("Failed to mount %s -> %s: %v", mnt.source, target, err)
+			fmt.Fprintf(os.Stderr, "✗ %s hook failed: %v\n", stage, err)
 		}
-		fmt.Printf("✓ Mounted %s\n", mnt.name)
 	}
 }
 
+// envFromProfile converts a profile's Env map into "KEY=VALUE" entries
+// appended to the chrooted command's environment. A nil profile yields nil.
+func envFromProfile(prof *profile.Profile) []string {
+	if prof == nil || len(prof.Env) == 0 {
+		return nil
+	}
+	env := make([]string, 0, len(prof.Env))
+	for k, v := range prof.Env {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
 func setupResolvConf(chrootDir string) {
 	hostResolv := "/etc/resolv.conf"
-	chrootResolv := filepath.Join(chrootDir, "etc/resolv.conf")
-	chrootEtcDir := filepath.Join(chrootDir, "etc")
+	etcDir, resolvName, err := securejoin.JoinParent(chrootDir, "etc/resolv.conf")
+	if err != nil {
+		fatalf("Failed to resolve etc/resolv.conf in chroot: %v", err)
+	}
+	defer etcDir.Close()
+	chrootResolv := filepath.Join(etcDir.Path(), resolvName)
 
 	logInfo("Setting up resolv.conf...")
 
 	// Создаём директорию /etc внутри chroot, если её нет
-	if err := os.MkdirAll(chrootEtcDir, 0755); err != nil {
+	if err := os.MkdirAll(etcDir.Path(), 0755); err != nil {
 		fatalf("Failed to create /etc in chroot: %v", err)
 	}
 
 	// Пытаемся создать симлинк
-	err := os.Symlink(hostResolv, chrootResolv)
+	err = os.Symlink(hostResolv, etcDir.Child(resolvName))
 	if err == nil {
 		fmt.Printf("✓ resolv.conf: symlinked %s → %s\n", hostResolv, chrootResolv)
 		return
@@ -183,7 +853,7 @@ func setupResolvConf(chrootDir string) {
 
 	// Если симлинк не получился — удаляем старый файл (если есть)
 	if _, statErr := os.Stat(chrootResolv); statErr == nil {
-		if err := os.Remove(chrootResolv); err != nil {
+		if err := os.Remove(etcDir.Child(resolvName)); err != nil {
 			fatalf("Failed to remove existing %s: %v", chrootResolv, err)
 		}
 		logInfo("Removed existing %s", chrootResolv)
@@ -198,7 +868,7 @@ func setupResolvConf(chrootDir string) {
 	}
 	defer src.Close()
 
-	dst, err := os.Create(chrootResolv)
+	dst, err := os.OpenFile(etcDir.Child(resolvName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		fatalf("Failed to create %s: %v", chrootResolv, err)
 	}
@@ -222,16 +892,17 @@ func checkMountpoint(chrootDir string) {
 	}
 }
 
+// isMounted reports whether path is itself a mountpoint, via the parsed
+// /proc/self/mountinfo table rather than shelling out to findmnt.
 func isMounted(path string) bool {
-	cmd := exec.Command("findmnt", "-n", "-o", "TARGET", "--target", path)
-	output, err := cmd.Output()
+	table, err := mountinfo.Parse()
 	if err != nil {
 		return false
 	}
-	return len(output) > 0
+	return table.IsMounted(path)
 }
 
-func runChroot(chrootDir string, userSpec string, cmdArgs []string) {
+func runChroot(chrootDir string, userSpec string, cmdArgs []string, extraEnv []string) {
 	// Собираем аргументы для chroot
 	args := []string{}
 	if userSpec != "" {
@@ -247,6 +918,9 @@ func runChroot(chrootDir string, userSpec string, cmdArgs []string) {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if len(extraEnv) > 0 {
+		cmd.Env = append(os.Environ(), extraEnv...)
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Pdeathsig: syscall.SIGTERM,
 	}
@@ -263,31 +937,45 @@ func runChroot(chrootDir string, userSpec string, cmdArgs []string) {
 	fmt.Printf("✓ chroot completed successfully\n")
 }
 
+// umountEssentials discovers every mount anywhere beneath chrootDir -
+// fchroot's own proc/sys/dev, a profile's extra binds, overlay layers, or
+// mounts left behind by a previous crashed run - and tears them down
+// deepest-first, falling back to MNT_DETACH for anything still busy.
 func umountEssentials(chrootDir string) {
-	// Размонтируем в обратном порядке!
-	mounts := []string{"dev", "sys", "proc"}
-
 	fmt.Println("→ Unmounting filesystems...")
 
-	for _, fs := range mounts {
-		target := filepath.Join(chrootDir, fs)
+	table, err := mountinfo.Parse()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "✗ Failed to read mountinfo: %v\n", err)
+		return
+	}
 
-		// Проверяем, смонтирован ли вообще
-		if !isMounted(target) {
-			logInfo("%s is not mounted, skipping", target)
+	// Under() matches chrootDir itself as well as everything beneath it, but
+	// chrootDir's own mountpoint isn't fchroot's to unmount here: in overlay
+	// mode it's ov.mergedDir, which ov.teardown owns and unmounts itself, and
+	// otherwise it predates this session entirely. Leaving it in would mean
+	// unmounting it twice - once here, once in ov.teardown - and the second
+	// attempt fails with EINVAL since it's no longer a mountpoint.
+	clean := filepath.Clean(chrootDir)
+	var entries []mountinfo.MountEntry
+	for _, e := range table.Under(chrootDir) {
+		if filepath.Clean(e.MountPoint) == clean {
 			continue
 		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.Count(entries[i].MountPoint, "/") > strings.Count(entries[j].MountPoint, "/")
+	})
 
-		logInfo("Unmounting %s", target)
+	for _, e := range entries {
+		target := e.MountPoint
+		logInfo("Unmounting %s (%s)", target, e.FSType)
 
 		// Пытаемся размонтировать несколько раз с задержкой
 		var lastErr error
 		for attempt := 1; attempt <= 3; attempt++ {
-			cmd := exec.Command("umount", target)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-
-			if err := cmd.Run(); err != nil {
+			if err := syscall.Unmount(target, 0); err != nil {
 				lastErr = err
 				if attempt < 3 {
 					logInfo("Attempt %d failed, retrying in 1s...", attempt)
@@ -302,17 +990,29 @@ func umountEssentials(chrootDir string) {
 		}
 
 		if lastErr != nil {
-			fmt.Fprintf(os.Stderr, "✗ Failed to unmount %s after 3 attempts: %v\n", target, lastErr)
-			fmt.Fprintf(os.Stderr, "   You may need to unmount it manually: umount %s\n", target)
+			logInfo("Retries exhausted for %s, forcing detach", target)
+			if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+				fmt.Fprintf(os.Stderr, "✗ Failed to unmount %s even with MNT_DETACH: %v\n", target, err)
+				fmt.Fprintf(os.Stderr, "   You may need to unmount it manually: umount -l %s\n", target)
+			} else {
+				fmt.Printf("✓ Detached %s (MNT_DETACH)\n", target)
+			}
 		}
 	}
 
 	// Также пытаемся размонтировать симлинк resolv.conf если он был создан
-	resolvPath := filepath.Join(chrootDir, "etc/resolv.conf")
+	etcDir, resolvName, err := securejoin.JoinParent(chrootDir, "etc/resolv.conf")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "✗ Failed to resolve etc/resolv.conf: %v\n", err)
+		fmt.Println("→ Cleanup completed")
+		return
+	}
+	defer etcDir.Close()
+	resolvPath := filepath.Join(etcDir.Path(), resolvName)
 	if fi, err := os.Lstat(resolvPath); err == nil {
 		if fi.Mode()&os.ModeSymlink != 0 {
 			// Это симлинк, можно удалить
-			if err := os.Remove(resolvPath); err == nil {
+			if err := os.Remove(etcDir.Child(resolvName)); err == nil {
 				logInfo("Removed resolv.conf symlink")
 			}
 		}